@@ -1,32 +1,235 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/dns/pkg/version"
 )
 
+// lastConfigHash tracks the hash of the last Corefile we wrote out, so that
+// a reload is only signalled to CoreDNS when the rendered contents actually
+// change. syncConfigMap delivers updates one at a time over a single
+// channel, so no additional locking is needed around it.
+var lastConfigHash [sha256.Size]byte
+
+// defaultMetricsPort is the port node-local-dns exposes CoreDNS metrics on.
+const defaultMetricsPort = 9253
+
+// corefileData is executed against the base Corefile template read from
+// c.params.cmPath. Each field is pre-rendered Corefile text (or a scalar)
+// for the matching template placeholder, e.g. "{{.StubDomains}}".
+type corefileData struct {
+	StubDomains         string
+	UpstreamNameservers string
+	Federations         string
+	Hosts               string
+	BindAddress         string
+	MetricsPort         int
+}
+
 func (c *cacheApp) updateConfig(config *config.Config) {
-	// construct part of the Corefile
-	cstr := ""
-	for domainName, servers := range config.StubDomains {
-		lines := []string{domainName + ":53 {", "\terrors", "\tcache 30", "\tforward . " + servers[0], "}"}
-		cstr = cstr + strings.Join(lines, "\n")
+	data := corefileData{
+		StubDomains:         stubDomainsBlock(config.StubDomains),
+		UpstreamNameservers: strings.Join(config.UpstreamNameservers, " "),
+		Federations:         federationsBlock(config.Federations, c.dnsConfig.ClusterDomain),
+		Hosts:               hostsBlock(config.Hosts),
+		BindAddress:         c.dnsConfig.DNSBindAddress,
+		MetricsPort:         defaultMetricsPort,
 	}
-	clog.Infof("WILL UPDATE CONFIG WITH %s", cstr)
-	baseConfig, err := ioutil.ReadFile(c.params.cmPath)
+	clog.Infof("WILL UPDATE CONFIG WITH %+v", data)
+
+	baseTemplate, err := ioutil.ReadFile(c.params.cmPath)
 	if err != nil {
 		clog.Errorf("Failed to read node-cache configmap %s - %v", c.params.cmPath, err)
 		return
 	}
-	strings.Replace(string(baseConfig), "STUB_DOMAINS", cstr, -1)
-	strings.Replace(string(baseConfig), "UPSTREAM_SERVERS", strings.Join(config.UpstreamNameservers, " "), -1)
-	err = ioutil.WriteFile(c.params.confFile, []byte(baseConfig), 0666)
+	rendered, err := renderCorefile(baseTemplate, data)
 	if err != nil {
+		clog.Errorf("Failed to render Corefile template %s - %v", c.params.cmPath, err)
+		return
+	}
+
+	if err := writeFileAtomic(c.params.confFile, rendered, 0666); err != nil {
 		clog.Errorf("Failed to write config file %s - err %v", c.params.confFile, err)
+		return
+	}
+
+	hash := sha256.Sum256(rendered)
+	if hash == lastConfigHash {
+		clog.Infof("Corefile unchanged, skipping reload")
+		return
+	}
+	lastConfigHash = hash
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		clog.Errorf("Failed to signal CoreDNS to reload %s - err %v", c.params.confFile, err)
+	}
+}
+
+// renderCorefile executes the base Corefile template (read from the
+// node-cache ConfigMap) against data, returning the rendered Corefile bytes.
+func renderCorefile(baseTemplate []byte, data corefileData) ([]byte, error) {
+	tmpl, err := template.New("Corefile").Parse(string(baseTemplate))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory as path,
+// fsyncs it, then renames it into place, so a crash or concurrent read never
+// observes a partially-written Corefile.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// stubDomainsBlock renders the Corefile server blocks for all configured
+// stub domains. Domains are visited in sorted order so the rendered text -
+// and therefore its hash - is stable across calls with identical input,
+// since Go randomizes map iteration order.
+func stubDomainsBlock(stubDomains map[string]config.StubDomainSpec) string {
+	names := make([]string, 0, len(stubDomains))
+	for domainName := range stubDomains {
+		names = append(names, domainName)
+	}
+	sort.Strings(names)
+
+	cstr := ""
+	for _, domainName := range names {
+		cstr = cstr + stubDomainBlock(domainName, stubDomains[domainName])
 	}
+	return cstr
+}
+
+// stubDomainBlock renders the Corefile server block for a single stub
+// domain, honoring its forwarding protocol, TLS settings, cache TTL and
+// health-check interval.
+func stubDomainBlock(domainName string, spec config.StubDomainSpec) string {
+	ttl := spec.CacheTTL
+	if ttl == 0 {
+		ttl = config.DefaultStubDomainCacheTTL
+	}
+	servers := make([]string, len(spec.Servers))
+	for i, s := range spec.Servers {
+		if spec.Protocol == "tls" {
+			servers[i] = "tls://" + s
+		} else {
+			servers[i] = s
+		}
+	}
+	lines := []string{
+		domainName + ":53 {",
+		"\terrors",
+		fmt.Sprintf("\tcache %d", ttl),
+		"\tforward . " + strings.Join(servers, " ") + " {",
+	}
+	if spec.Protocol == "tls" {
+		lines = append(lines, "\t\ttls_servername "+spec.TLSServerName)
+		if spec.CACertPath != "" {
+			lines = append(lines, "\t\ttls "+spec.CACertPath)
+		}
+	}
+	if spec.Protocol == "tcp" {
+		lines = append(lines, "\t\tforce_tcp")
+	}
+	if spec.HealthCheck != "" {
+		lines = append(lines, "\t\thealth_check "+spec.HealthCheck)
+	}
+	if spec.MaxConcurrent > 0 {
+		lines = append(lines, fmt.Sprintf("\t\tmax_concurrent %d", spec.MaxConcurrent))
+	}
+	lines = append(lines, "\t}", "}")
+	return strings.Join(lines, "\n")
+}
+
+// federationsBlock renders a CoreDNS "federation" plugin block so that
+// <name>.<federation-domain>.svc.<cluster-domain> queries are rewritten to
+// their federated form and forwarded to the appropriate upstream. Names are
+// visited in sorted order so the rendered text is stable across calls with
+// identical input.
+func federationsBlock(federations map[string]string, clusterDomain string) string {
+	if len(federations) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(federations))
+	for name := range federations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"federation " + clusterDomain + " {"}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("\t%s %s", name, federations[name]))
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+// hostsBlock renders a CoreDNS "hosts" plugin block serving the configured
+// name -> IP mappings as authoritative records, for inclusion in the shared
+// catch-all server block. The hosts plugin is itself authoritative for the
+// whole block, so it must fall through to whatever comes after it (e.g. the
+// forward plugin) for names it doesn't know about - otherwise every query in
+// the block would start returning NXDOMAIN the moment any Hosts entry is
+// configured. Names are visited in sorted order so the rendered text is
+// stable across calls with identical input.
+func hostsBlock(hosts map[string][]string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"hosts {"}
+	for _, name := range names {
+		for _, ip := range hosts[name] {
+			lines = append(lines, fmt.Sprintf("\t%s %s", ip, name))
+		}
+	}
+	lines = append(lines, "\tno_reverse", "\tfallthrough", "}")
+	return strings.Join(lines, "\n")
 }
 
 func (c *cacheApp) syncConfigMap(syncChan <-chan *config.Config) {
@@ -36,14 +239,53 @@ func (c *cacheApp) syncConfigMap(syncChan <-chan *config.Config) {
 	}
 }
 
+// kubeClientBackoff bounds how hard initConfigMapSync retries creating an
+// in-cluster client before giving up and falling back to file-based sync.
+var kubeClientBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Steps:    5,
+	Cap:      30 * time.Second,
+}
+
+// initConfigMapSync wires up the node-local-dns config source. When an
+// in-cluster kube client is available, it watches the kube-dns ConfigMap via
+// a shared informer (config.NewConfigMapSync), so updateConfig is invoked on
+// the actual ADDED/MODIFIED events instead of on a fixed interval. Client
+// creation is retried with exponential backoff, since this runs at process
+// startup and a transient apiserver hiccup shouldn't permanently strand the
+// node on file-based sync. If no in-cluster config can be obtained at all,
+// or no ConfigMap name is configured to watch, it falls back to polling the
+// ConfigMap mounted as a directory.
 func (c *cacheApp) initConfigMapSync() {
-	/*
-		kubeClient, err := util.GetDefaultKubeClient("nodelocaldns-%s", version.Version)
+	if c.dnsConfig.ConfigMap == "" {
+		clog.Infof("No ConfigMap name configured, falling back to file-based sync from /etc/kube-dns/")
+		c.dnsConfig.ConfigDir = "/etc/kube-dns/"
+		c.startConfigSync(nil)
+		return
+	}
+
+	var kubeClient kubernetes.Interface
+	err := wait.ExponentialBackoff(kubeClientBackoff, func() (bool, error) {
+		var err error
+		kubeClient, err = util.GetDefaultKubeClient(fmt.Sprintf("nodelocaldns-%s", version.VERSION))
 		if err != nil {
-			glog.Fatalf("Failed to create a kubernetes client: %v", err)
+			clog.Errorf("Failed to create a kubernetes client, retrying: %v", err)
+			return false, nil
 		}
-	*/
-	c.dnsConfig.ConfigDir = "/etc/kube-dns/"
-	configSync := config.NewConfigSync(nil, c.dnsConfig)
-	config.StartConfigMapSync(&configSync, c.updateConfig, c.syncConfigMap)
+		return true, nil
+	})
+	if err != nil {
+		clog.Errorf("Giving up on creating a kubernetes client after retries, falling back to file-based sync: %v", err)
+		c.dnsConfig.ConfigMap = ""
+		c.dnsConfig.ConfigDir = "/etc/kube-dns/"
+	}
+	c.startConfigSync(kubeClient)
+}
+
+func (c *cacheApp) startConfigSync(kubeClient kubernetes.Interface) {
+	configSync := config.NewConfigSync(kubeClient, c.dnsConfig)
+	if err := config.StartConfigMapSync(&configSync, c.updateConfig, c.syncConfigMap); err != nil {
+		clog.Errorf("Failed to start config sync: %v", err)
+	}
 }
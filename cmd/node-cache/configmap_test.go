@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// TestRenderCorefileRoundTrip builds a corefileData from a sample Config,
+// renders it against a template resembling the node-local-dns base
+// ConfigMap, and asserts the result is both substituted correctly and
+// parses as a valid Corefile with the server blocks we expect.
+//
+// StubDomains and Federations each render their own top-level
+// "name:53 { ... }" / "federation ... { ... }" blocks, so the placeholders
+// for them must sit as siblings of the catch-all ".:53" block rather than
+// nested inside it. Hosts renders a plugin stanza, not a server block, so it
+// belongs inside ".:53" alongside the other plugins of that zone.
+func TestRenderCorefileRoundTrip(t *testing.T) {
+	base := []byte(`.:53 {
+    errors
+    cache 30
+    {{.Hosts}}
+    forward . {{.UpstreamNameservers}}
+    bind {{.BindAddress}}
+}
+{{.StubDomains}}
+{{.Federations}}
+`)
+
+	data := corefileData{
+		StubDomains: stubDomainsBlock(map[string]config.StubDomainSpec{
+			"acme.local": {Servers: []string{"1.2.3.4"}},
+		}),
+		UpstreamNameservers: "8.8.8.8 8.8.4.4",
+		Federations:         federationsBlock(map[string]string{"myfed": "example.com"}, "cluster.local"),
+		Hosts:               hostsBlock(map[string][]string{"foo.svc": {"10.0.0.1"}}),
+		BindAddress:         "0.0.0.0",
+		MetricsPort:         defaultMetricsPort,
+	}
+
+	got, err := renderCorefile(base, data)
+	if err != nil {
+		t.Fatalf("renderCorefile() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"acme.local:53 {",
+		"forward . 1.2.3.4",
+		"8.8.8.8 8.8.4.4",
+		"federation cluster.local {",
+		"myfed example.com",
+		"hosts {",
+		"10.0.0.1 foo.svc",
+		"fallthrough",
+		"bind 0.0.0.0",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered Corefile missing %q:\n%s", want, got)
+		}
+	}
+
+	blocks, err := caddyfile.Parse("Corefile", strings.NewReader(string(got)), nil)
+	if err != nil {
+		t.Fatalf("rendered Corefile failed to parse: %v\n%s", err, got)
+	}
+
+	wantKeys := [][]string{
+		{".:53"},
+		{"acme.local:53"},
+		{"federation", "cluster.local"},
+	}
+	if len(blocks) != len(wantKeys) {
+		t.Fatalf("rendered Corefile has %d server blocks, want %d (stub domains/federations must be sibling top-level blocks, not nested inside .:53):\n%s", len(blocks), len(wantKeys), got)
+	}
+	for i, block := range blocks {
+		if !reflect.DeepEqual(block.Keys, wantKeys[i]) {
+			t.Errorf("server block %d keys = %v, want %v", i, block.Keys, wantKeys[i])
+		}
+	}
+
+	// The hosts plugin must live inside the ".:53" block, alongside forward,
+	// not as its own top-level server block.
+	if _, ok := blocks[0].Tokens["hosts"]; !ok {
+		t.Errorf("hosts plugin not found inside the .:53 block:\n%s", got)
+	}
+}
+
+// TestRenderCorefileStableOnRepeat checks that stubDomainsBlock renders the
+// same stub domains byte-identically on repeated calls despite Go's random
+// map iteration order, since otherwise the hash-based reload-skip in
+// updateConfig would fire spuriously. hostsBlock and federationsBlock are
+// not exercised here.
+func TestRenderCorefileStableOnRepeat(t *testing.T) {
+	stubDomains := map[string]config.StubDomainSpec{
+		"a.local": {Servers: []string{"1.1.1.1"}},
+		"b.local": {Servers: []string{"2.2.2.2"}},
+		"c.local": {Servers: []string{"3.3.3.3"}},
+		"d.local": {Servers: []string{"4.4.4.4"}},
+		"e.local": {Servers: []string{"5.5.5.5"}},
+	}
+
+	first := stubDomainsBlock(stubDomains)
+	for i := 0; i < 10; i++ {
+		if got := stubDomainsBlock(stubDomains); got != first {
+			t.Fatalf("stubDomainsBlock() not stable across calls:\nfirst=%s\ngot=%s", first, got)
+		}
+	}
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -46,26 +48,86 @@ type Config struct {
 	// is running belongs to, to the corresponding domain names.
 	Federations map[string]string `json:"federations"`
 
-	// Map of stub domain to nameserver IP. The key is the domain name suffix,
-	// e.g. "acme.local". Key cannot be equal to the cluster domain. Value is
-	// the IP of the nameserver to send DNS request for the given subdomain.
-	StubDomains map[string][]string `json:"stubDomains"`
+	// Map of stub domain to its forwarding policy. The key is the domain name
+	// suffix, e.g. "acme.local". Key cannot be equal to the cluster domain.
+	// For backward compatibility, a value may also be unmarshalled from the
+	// legacy bare list-of-nameservers form.
+	StubDomains map[string]StubDomainSpec `json:"stubDomains"`
 
 	// List of upstream nameservers to use. Overrides nameservers inherited
 	// from the node.
 	UpstreamNameservers []string `json:"upstreamNameservers"`
+
+	// Map of hostname to a list of IPs that should be served locally as
+	// authoritative A/AAAA records instead of being forwarded upstream.
+	// This lets node-local-dns answer for arbitrary in-cluster names, e.g.
+	// egress endpoints exposed on cluster IPs, without a round trip to
+	// kube-dns.
+	Hosts map[string][]string `json:"hosts"`
 }
 
 func NewDefaultConfig() *Config {
 	return &Config{
 		Federations: map[string]string{},
-		StubDomains: map[string][]string{},
+		StubDomains: map[string]StubDomainSpec{},
+		Hosts:       map[string][]string{},
+	}
+}
+
+// DefaultStubDomainCacheTTL is used for a stub domain that doesn't specify
+// its own CacheTTL.
+const DefaultStubDomainCacheTTL = 30
+
+// StubDomainSpec describes how queries for a stub domain should be
+// forwarded upstream.
+type StubDomainSpec struct {
+	// Servers is the list of nameserver addresses (ip[:port]) to forward to.
+	Servers []string `json:"servers"`
+
+	// Protocol is the transport used to reach Servers: "udp" (the default),
+	// "tcp", or "tls".
+	Protocol string `json:"protocol,omitempty"`
+
+	// TLSServerName is the server name expected in the upstream's
+	// certificate. Required when Protocol is "tls".
+	TLSServerName string `json:"tlsServerName,omitempty"`
+
+	// CACertPath is an optional path to a CA bundle used to verify the
+	// upstream's certificate. Only used when Protocol is "tls".
+	CACertPath string `json:"caCertPath,omitempty"`
+
+	// CacheTTL, in seconds, for responses served from this zone. Defaults
+	// to 30 seconds when unset.
+	CacheTTL int `json:"cacheTTL,omitempty"`
+
+	// MaxConcurrent caps the number of concurrent queries forwarded to
+	// Servers. Unlimited when unset.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+
+	// HealthCheck is the interval between upstream health checks, e.g.
+	// "5s". Disabled when unset.
+	HealthCheck string `json:"healthCheck,omitempty"`
+}
+
+// UnmarshalJSON allows a StubDomainSpec to be populated either from the
+// structured form above, or from the legacy bare list of nameservers (e.g.
+// `["1.2.3.4", "5.6.7.8:53"]`), so existing ConfigMaps keep working
+// unchanged.
+func (s *StubDomainSpec) UnmarshalJSON(data []byte) error {
+	var servers []string
+	if err := json.Unmarshal(data, &servers); err == nil {
+		*s = StubDomainSpec{Servers: servers}
+		return nil
 	}
+	type plain StubDomainSpec
+	return json.Unmarshal(data, (*plain)(s))
 }
 
-// Validate returns whether or not the configuration is valid.
-func (config *Config) Validate() error {
-	if err := config.validateFederations(); err != nil {
+// Validate returns whether or not the configuration is valid. clusterDomain
+// is the cluster's own domain (DNSConfig.ClusterDomain), which a federation
+// domain may not collide with.
+func (config *Config) Validate(clusterDomain string) error {
+	if err := config.validateFederations(clusterDomain); err != nil {
 		return err
 	}
 
@@ -77,10 +139,15 @@ func (config *Config) Validate() error {
 		return err
 	}
 
+	if err := config.validateHosts(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (config *Config) validateFederations() error {
+func (config *Config) validateFederations(clusterDomain string) error {
+	domainToName := map[string]string{}
 	for name, domain := range config.Federations {
 		if err := fed.ValidateName(name); err != nil {
 			return err
@@ -88,26 +155,59 @@ func (config *Config) validateFederations() error {
 		if err := fed.ValidateDomain(domain); err != nil {
 			return err
 		}
+		if domain == clusterDomain {
+			return fmt.Errorf("federation domain %q for %q collides with the cluster domain", domain, name)
+		}
+		if other, ok := domainToName[domain]; ok {
+			return fmt.Errorf("federation domain %q is used by both %q and %q", domain, other, name)
+		}
+		domainToName[domain] = name
 	}
 	return nil
 }
 
 func (config *Config) validateStubDomains() error {
-	for domain, nsList := range config.StubDomains {
+	for domain, spec := range config.StubDomains {
 		if len(validation.IsDNS1123Subdomain(domain)) != 0 {
 			return fmt.Errorf("invalid domain name: %q", domain)
 		}
 
-		for _, ns := range nsList {
-			// TODO(rramkumar): Use net.SplitHostPort to support ipv6 case.
-			nsStrings := strings.SplitN(ns, ":", 2)
-			// Validate port if specified
-			if len(nsStrings) == 2 {
-				if _, err := strconv.ParseUint(nsStrings[1], 10, 16); err != nil {
+		switch spec.Protocol {
+		case "", "udp", "tcp":
+		case "tls":
+			if spec.TLSServerName == "" {
+				return fmt.Errorf("stub domain %q: tlsServerName is required when protocol is \"tls\"", domain)
+			}
+		default:
+			return fmt.Errorf("stub domain %q: invalid protocol %q", domain, spec.Protocol)
+		}
+
+		for _, ns := range spec.Servers {
+			// A nameserver may be a bare IP (v4 or v6), a bracketed IPv6
+			// literal with a port ("[2001:db8::1]:53"), a "host:port" pair,
+			// or a bare hostname. net.SplitHostPort only understands the
+			// "host:port" forms, so fall back to it once net.ParseIP rules
+			// out a bare address.
+			host, port := ns, ""
+			if net.ParseIP(ns) == nil {
+				h, p, err := net.SplitHostPort(ns)
+				if err != nil {
+					// A bare hostname with no port also lands here,
+					// since SplitHostPort requires a colon; keep treating
+					// the whole string as the host in that case.
+					if aerr, ok := err.(*net.AddrError); !ok || aerr.Err != "missing port in address" {
+						return fmt.Errorf("invalid nameserver: %q", ns)
+					}
+				} else {
+					host, port = h, p
+				}
+			}
+			if port != "" {
+				if _, err := strconv.ParseUint(port, 10, 16); err != nil {
 					return fmt.Errorf("invalid nameserver: %q", ns)
 				}
 			}
-			if len(validation.IsValidIP(nsStrings[0])) > 0 && len(validation.IsDNS1123Subdomain(ns)) > 0 {
+			if net.ParseIP(host) == nil && len(validation.IsDNS1123Subdomain(host)) > 0 {
 				return fmt.Errorf("invalid nameserver: %q", ns)
 			}
 		}
@@ -116,6 +216,25 @@ func (config *Config) validateStubDomains() error {
 	return nil
 }
 
+// validateHosts checks that every entry in Hosts is a valid DNS name mapped
+// to a list of valid IP addresses.
+func (config *Config) validateHosts() error {
+	for name, ips := range config.Hosts {
+		if len(validation.IsDNS1123Subdomain(name)) != 0 {
+			return fmt.Errorf("invalid hostname: %q", name)
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("host %q has no IPs", name)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid IP %q for host %q", ip, name)
+			}
+		}
+	}
+	return nil
+}
+
 func (config *Config) validateUpstreamNameserver() error {
 
 	if len(config.UpstreamNameservers) > 3 {
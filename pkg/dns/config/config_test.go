@@ -0,0 +1,172 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateStubDomains(t *testing.T) {
+	tests := []struct {
+		name        string
+		stubDomains map[string]StubDomainSpec
+		wantErr     bool
+	}{
+		{
+			name: "bare IPv4",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"1.2.3.4"}},
+			},
+		},
+		{
+			name: "IPv4 with port",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"1.2.3.4:53"}},
+			},
+		},
+		{
+			name: "bare IPv6",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"2001:db8::1"}},
+			},
+		},
+		{
+			name: "bracketed IPv6 with port",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"[2001:db8::1]:53"}},
+			},
+		},
+		{
+			name: "mixed v4 and v6 in one stub domain",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"1.2.3.4", "[2001:db8::1]:53", "2001:db8::2"}},
+			},
+		},
+		{
+			name: "bare hostname",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"ns.example.com"}},
+			},
+		},
+		{
+			name: "hostname with port",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"ns.example.com:53"}},
+			},
+		},
+		{
+			name: "invalid IPv6 missing brackets with port is rejected",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"2001:db8::1:gg"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid port",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"1.2.3.4:notaport"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "tls protocol without server name is rejected",
+			stubDomains: map[string]StubDomainSpec{
+				"acme.local": {Servers: []string{"1.2.3.4"}, Protocol: "tls"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{StubDomains: tt.stubDomains}
+			err := cfg.validateStubDomains()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateStubDomains() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "valid host with multiple IPs",
+			hosts: map[string][]string{
+				"foo.svc.cluster.local": {"10.0.0.1", "2001:db8::1"},
+			},
+		},
+		{
+			name: "empty IP list is rejected",
+			hosts: map[string][]string{
+				"foo.svc.cluster.local": {},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid IP is rejected",
+			hosts: map[string][]string{
+				"foo.svc.cluster.local": {"not-an-ip"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid hostname is rejected",
+			hosts: map[string][]string{
+				"Foo_Bar": {"10.0.0.1"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Hosts: tt.hosts}
+			err := cfg.validateHosts()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpstreamNameserverMixedIPVersions(t *testing.T) {
+	cfg := &Config{
+		UpstreamNameservers: []string{"1.2.3.4", "[2001:db8::1]:53", "2001:db8::2"},
+	}
+	if err := cfg.validateUpstreamNameserver(); err != nil {
+		t.Errorf("validateUpstreamNameserver() with mixed v4/v6 list = %v, want nil", err)
+	}
+}
+
+func TestStubDomainSpecUnmarshalJSON(t *testing.T) {
+	cfg := &Config{}
+	data := []byte(`{"stubDomains": {"legacy.local": ["1.2.3.4", "[2001:db8::1]:53"]}}`)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		t.Fatalf("unmarshal legacy stub domain form: %v", err)
+	}
+	got := cfg.StubDomains["legacy.local"]
+	want := StubDomainSpec{Servers: []string{"1.2.3.4", "[2001:db8::1]:53"}}
+	if len(got.Servers) != len(want.Servers) || got.Servers[0] != want.Servers[0] || got.Servers[1] != want.Servers[1] {
+		t.Errorf("legacy unmarshal = %+v, want %+v", got, want)
+	}
+}
@@ -97,6 +97,8 @@ func HashServiceRecord(msg *msg.Service) string {
 
 // ValidateNameserverIpAndPort splits and validates ip and port for nameserver.
 // If there is no port in the given address, a default 53 port will be returned.
+// Both IPv4 and IPv6 addresses are accepted; IPv6 addresses with a port must
+// be bracketed, e.g. "[2001:db8::1]:53".
 func ValidateNameserverIpAndPort(nameServer string) (string, string, error) {
 	if ip := net.ParseIP(nameServer); ip != nil {
 		return ip.String(), "53", nil